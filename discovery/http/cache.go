@@ -0,0 +1,96 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+)
+
+// maxCacheFailures bounds how many consecutive refresh failures are masked
+// by falling back to the on-disk cache before the real error is returned
+// and the cached targets are allowed to go stale in the caller's eyes.
+const maxCacheFailures = 10
+
+// diskCache is the on-disk representation of the last successful http_sd
+// response, written to SDConfig.CacheFile so http_sd survives restarts and
+// SD-server outages without churning scrape targets.
+type diskCache struct {
+	ETag   string               `json:"etag"`
+	Groups []*targetgroup.Group `json:"groups"`
+	// Sources holds each group's Source, which targetgroup.Group's own
+	// JSON encoding leaves out.
+	Sources []string `json:"sources"`
+}
+
+func loadCacheFile(path string) (*diskCache, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var c diskCache
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, err
+	}
+	for i, tg := range c.Groups {
+		if tg != nil && i < len(c.Sources) {
+			tg.Source = c.Sources[i]
+		}
+	}
+	return &c, nil
+}
+
+// writeCacheFile writes via a temp file plus rename so a process kill or
+// disk-full error mid-write can never leave a truncated, unparseable cache
+// file behind for the next loadCacheFile to trip over.
+func writeCacheFile(path string, etag string, groups []*targetgroup.Group) error {
+	sources := make([]string, len(groups))
+	for i, tg := range groups {
+		if tg != nil {
+			sources[i] = tg.Source
+		}
+	}
+	b, err := json.Marshal(diskCache{ETag: etag, Groups: groups, Sources: sources})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	_, writeErr := tmp.Write(b)
+	closeErr := tmp.Close()
+	if writeErr != nil {
+		os.Remove(tmpPath)
+		return writeErr
+	}
+	if closeErr != nil {
+		os.Remove(tmpPath)
+		return closeErr
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
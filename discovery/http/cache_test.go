@@ -0,0 +1,48 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/targetgroup"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestCacheFileRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "http_sd_cache")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "cache.json")
+	groups := []*targetgroup.Group{
+		{
+			Source: "http://example.com:0",
+			Targets: []model.LabelSet{
+				{model.AddressLabel: "somehost:8080"},
+			},
+		},
+	}
+
+	testutil.Ok(t, writeCacheFile(path, "etag-1", groups))
+
+	cache, err := loadCacheFile(path)
+	testutil.Ok(t, err)
+	testutil.Equals(t, "etag-1", cache.ETag)
+	testutil.Equals(t, groups, cache.Groups)
+}
@@ -14,14 +14,20 @@
 package http
 
 import (
+	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/pkg/errors"
 	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
@@ -31,11 +37,52 @@ import (
 
 const httpSourceLabel = model.MetaLabelPrefix + "http_source_url"
 
+// Mode selects how a URL endpoint obtains target group updates.
+type Mode string
+
+const (
+	// ModePoll issues a GET request every RefreshInterval. This is the
+	// default and is what every SD endpoint must support.
+	ModePoll Mode = "poll"
+	// ModeStream keeps a single long-lived HTTP connection open and
+	// consumes target group updates as they are pushed, falling back to
+	// ModePoll if the stream cannot be established or is interrupted.
+	ModeStream Mode = "stream"
+)
+
+// URLEntry configures a single SD endpoint within a (possibly multi-URL)
+// http_sd_config. It carries its own auth and refresh interval so one
+// Prometheus can poll several heterogeneous registries under a single
+// http_sd_configs entry.
+type URLEntry struct {
+	URL              config.URL              `yaml:"url"`
+	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
+	RefreshInterval  model.Duration          `yaml:"refresh_interval,omitempty"`
+	// LabelPrefix, if set, is used as the full name of the meta label that
+	// carries this entry's URL on each of its target groups, in place of
+	// __meta_http_source_url. It is not prepended to any other label name.
+	LabelPrefix string `yaml:"label_prefix,omitempty"`
+}
+
 // SDConfig is the configuration for file based discovery.
 type SDConfig struct {
-	URL              config.URL              `yaml:"url"`
+	// URL and HTTPClientConfig/RefreshInterval at the top level are kept
+	// for backwards compatibility with single-endpoint configs; they are
+	// folded into URLs by UnmarshalYAML. New configs should prefer URLs.
+	URL              config.URL              `yaml:"url,omitempty"`
 	HTTPClientConfig config.HTTPClientConfig `yaml:",inline"`
 	RefreshInterval  model.Duration          `yaml:"refresh_interval,omitempty"`
+	URLs             []URLEntry              `yaml:"urls,omitempty"`
+
+	Mode            Mode   `yaml:"mode,omitempty"`
+	LabelsDir       string `yaml:"labels_dir,omitempty"`
+	LabelsDirPrefix string `yaml:"labels_dir_prefix,omitempty"`
+	CacheFile       string `yaml:"cache_file,omitempty"`
+
+	// TargetTTL, if non-zero, deregisters a target group that hasn't been
+	// observed in a successful response for longer than TargetTTL, even if
+	// the SD server itself has gone silent or unreachable.
+	TargetTTL model.Duration `yaml:"target_ttl,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface
@@ -51,27 +98,61 @@ func (c *SDConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
-	err = c.HTTPClientConfig.Validate()
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = model.Duration(5 * time.Minute)
+	}
 
-	if c.URL.URL == nil {
-		return errors.Errorf("url is required")
+	if len(c.URLs) > 0 && c.URL.URL != nil {
+		return errors.Errorf("at most one of url and urls may be configured")
 	}
 
-	if c.RefreshInterval == 0 {
-		c.RefreshInterval = model.Duration(5 * time.Minute)
+	if len(c.URLs) == 0 {
+		if c.URL.URL == nil {
+			return errors.Errorf("url is required")
+		}
+		c.URLs = []URLEntry{
+			{
+				URL:              c.URL,
+				HTTPClientConfig: c.HTTPClientConfig,
+				RefreshInterval:  c.RefreshInterval,
+			},
+		}
+	}
+
+	for i := range c.URLs {
+		entry := &c.URLs[i]
+		if entry.URL.URL == nil {
+			return errors.Errorf("url is required for urls[%d]", i)
+		}
+		if err := entry.HTTPClientConfig.Validate(); err != nil {
+			return err
+		}
+		if entry.RefreshInterval == 0 {
+			entry.RefreshInterval = c.RefreshInterval
+		}
+	}
+
+	if c.LabelsDir != "" && c.LabelsDirPrefix == "" {
+		c.LabelsDirPrefix = defaultLabelsDirPrefix
+	}
+
+	switch c.Mode {
+	case "":
+		c.Mode = ModePoll
+	case ModePoll, ModeStream:
+	default:
+		return errors.Errorf("unknown http_sd mode %q", c.Mode)
 	}
 
 	return nil
 }
 
-// Discovery implements the discoverer interface for discovering
-// targets from an HTTP service.
+// Discovery implements the discoverer interface for discovering targets
+// from one or more HTTP services. Each configured URLEntry is polled (or
+// streamed) independently and results are merged into a single stream.
 type Discovery struct {
-	*refresh.Discovery
-	url         *url.URL
-	client      *http.Client
-	lastRefresh map[string]bool
-	etag        string
+	subs   []*endpointDiscovery
+	logger log.Logger
 }
 
 // NewDiscovery creates a new HTTP discovery.
@@ -80,57 +161,537 @@ func NewDiscovery(conf *SDConfig, logger log.Logger) (*Discovery, error) {
 		logger = log.NewNopLogger()
 	}
 
-	rt, err := config.NewRoundTripperFromConfig(conf.HTTPClientConfig, "http_sd", false)
+	urls := conf.URLs
+	if len(urls) == 0 && conf.URL.URL != nil {
+		// conf may have been built directly rather than through
+		// UnmarshalYAML, which is what normally folds the legacy
+		// single-URL fields into URLs.
+		urls = []URLEntry{
+			{
+				URL:              conf.URL,
+				HTTPClientConfig: conf.HTTPClientConfig,
+				RefreshInterval:  conf.RefreshInterval,
+			},
+		}
+	}
+
+	var labelsLoader *labelsDirLoader
+	if conf.LabelsDir != "" {
+		labelsLoader = newLabelsDirLoader(conf.LabelsDir, logger)
+	}
+
+	d := &Discovery{logger: logger}
+
+	for i, entry := range urls {
+		cacheFile := conf.CacheFile
+		if cacheFile != "" && len(urls) > 1 {
+			cacheFile = fmt.Sprintf("%s.%d", cacheFile, i)
+		}
+
+		ed, err := newEndpointDiscovery(i, entry, conf.Mode, cacheFile, labelsLoader, conf.LabelsDirPrefix, time.Duration(conf.TargetTTL), logger)
+		if err != nil {
+			return nil, err
+		}
+		d.subs = append(d.subs, ed)
+	}
+
+	return d, nil
+}
+
+// Run implements discovery.Discoverer, running every configured endpoint
+// concurrently and forwarding each one's updates to up as they arrive.
+func (d *Discovery) Run(ctx context.Context, up chan<- []*targetgroup.Group) {
+	var wg sync.WaitGroup
+	for _, sub := range d.subs {
+		sub := sub
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sub.Run(ctx, up)
+		}()
+	}
+	wg.Wait()
+}
+
+// LastWarnings returns the non-fatal warnings reported by every configured
+// endpoint on its most recent successful refresh.
+func (d *Discovery) LastWarnings() []string {
+	var warnings []string
+	for _, sub := range d.subs {
+		warnings = append(warnings, sub.LastWarnings()...)
+	}
+	return warnings
+}
+
+// endpointDiscovery discovers targets from a single HTTP SD endpoint. It is
+// the unit Discovery fans out to for multi-URL http_sd_configs.
+type endpointDiscovery struct {
+	*refresh.Discovery
+	index           int
+	labelPrefix     string
+	url             *url.URL
+	client          *http.Client
+	mode            Mode
+	refreshInterval time.Duration
+	logger          log.Logger
+	etag            string
+
+	labelsDirPrefix string
+	labelsLoader    *labelsDirLoader
+
+	cacheFile           string
+	lastGood            []*targetgroup.Group
+	initialCache        []*targetgroup.Group
+	consecutiveFailures int
+
+	// targetTTL, lastSeen and expiresAt implement SDConfig.TargetTTL and
+	// the per-group "expires_at" field: a group is deregistered once it
+	// hasn't been seen in a successful response for targetTTL, or once
+	// its explicit expiry time has passed, whichever comes first.
+	targetTTL time.Duration
+	lastSeen  map[string]time.Time
+	expiresAt map[string]time.Time
+
+	mtx          sync.Mutex
+	lastWarnings []string
+}
+
+func newEndpointDiscovery(index int, entry URLEntry, mode Mode, cacheFile string, labelsLoader *labelsDirLoader, labelsDirPrefix string, targetTTL time.Duration, logger log.Logger) (*endpointDiscovery, error) {
+	rt, err := config.NewRoundTripperFromConfig(entry.HTTPClientConfig, "http_sd", false)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{
-		Transport: rt,
+	labelPrefix := entry.LabelPrefix
+	if labelPrefix == "" {
+		labelPrefix = string(httpSourceLabel)
+	}
+
+	ed := &endpointDiscovery{
+		index:           index,
+		labelPrefix:     labelPrefix,
+		url:             entry.URL.URL,
+		client:          &http.Client{Transport: rt},
+		mode:            mode,
+		refreshInterval: time.Duration(entry.RefreshInterval),
+		logger:          logger,
+		labelsDirPrefix: labelsDirPrefix,
+		labelsLoader:    labelsLoader,
+		cacheFile:       cacheFile,
+		targetTTL:       targetTTL,
+		lastSeen:        make(map[string]time.Time),
+		expiresAt:       make(map[string]time.Time),
 	}
 
-	d := &Discovery{
-		url:         conf.URL.URL,
-		client:      client,
-		lastRefresh: make(map[string]bool),
+	if cacheFile != "" {
+		if cache, err := loadCacheFile(cacheFile); err != nil {
+			// A missing cache file is the common case on a fresh install
+			// and is not worth warning about; any other error (e.g. a
+			// corrupt file) is.
+			if !os.IsNotExist(err) {
+				level.Warn(logger).Log("msg", "failed to load http_sd cache file", "file", cacheFile, "err", err)
+			}
+		} else {
+			ed.etag = cache.ETag
+			ed.lastGood = cache.Groups
+			ed.initialCache = cache.Groups
+		}
 	}
 
-	d.Discovery = refresh.NewDiscovery(
+	ed.Discovery = refresh.NewDiscovery(
 		logger,
-		"dns",
-		time.Duration(conf.RefreshInterval),
-		d.refresh,
+		"http",
+		time.Duration(entry.RefreshInterval),
+		ed.refresh,
 	)
 
-	return d, nil
+	return ed, nil
+}
+
+// Run implements discovery.Discoverer. In ModeStream it keeps a long-lived
+// connection open and pushes target group updates as soon as they arrive,
+// falling back to the inherited poll loop if the stream cannot be
+// maintained.
+func (ed *endpointDiscovery) Run(ctx context.Context, up chan<- []*targetgroup.Group) {
+	if ed.initialCache != nil {
+		select {
+		case up <- ed.initialCache:
+		case <-ctx.Done():
+			return
+		}
+		ed.initialCache = nil
+	}
+
+	if ed.mode != ModeStream {
+		ed.Discovery.Run(ctx, up)
+		return
+	}
+
+	if err := ed.stream(ctx, up); err != nil && ctx.Err() == nil {
+		level.Warn(ed.logger).Log("msg", "http_sd stream ended, falling back to polling", "err", err)
+	}
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	ed.Discovery.Run(ctx, up)
+}
+
+// streamEvent is a parsed stream line, or the error that ended the stream.
+type streamEvent struct {
+	tgs []*targetgroup.Group
+	err error
+}
+
+// stream opens a long-lived GET request against ed.url and forwards every
+// event it receives to up. While the connection is open it also checks
+// targetTTL and explicit "expires_at" expiry on a ticker, since no poll tick
+// will otherwise do so for as long as the stream stays up. It returns when
+// the connection is closed, the context is cancelled, or the body cannot be
+// parsed.
+func (ed *endpointDiscovery) stream(ctx context.Context, up chan<- []*targetgroup.Group) error {
+	req, err := http.NewRequest(http.MethodGet, ed.url.String(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "http_sd: failed to build stream request for url %s", ed.url)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "text/event-stream, application/x-ndjson")
+
+	resp, err := ed.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "http_sd: failed to open stream to url %s", ed.url)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("http_sd: unexpected HTTP status %d from stream url %s", resp.StatusCode, ed.url)
+	}
+
+	// Buffered by 1, and every producer send also selects on ctx.Done():
+	// once stream() returns (the common case is ctx cancellation on
+	// reload/shutdown), nothing reads events again, so an unguarded send
+	// would leak this goroutine, and its closed response body, forever.
+	events := make(chan streamEvent, 1)
+	sendEvent := func(ev streamEvent) {
+		select {
+		case events <- ev:
+		case <-ctx.Done():
+		}
+	}
+	go func() {
+		defer close(events)
+
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			// Server-Sent Events prefix data lines with "data:"; plain
+			// chunked JSON-lines streams do not.
+			line = strings.TrimPrefix(line, "data:")
+			line = strings.TrimSpace(line)
+			if line == "" {
+				continue
+			}
+
+			tgs, err := ed.parseStreamEvent([]byte(line))
+			if err != nil {
+				sendEvent(streamEvent{err: errors.Wrap(err, "http_sd: failed to parse stream event")})
+				return
+			}
+			if tgs == nil {
+				continue
+			}
+			sendEvent(streamEvent{tgs: tgs})
+		}
+
+		if err := scanner.Err(); err != nil {
+			sendEvent(streamEvent{err: errors.Wrap(err, "http_sd: stream read error")})
+			return
+		}
+		sendEvent(streamEvent{err: errors.New("stream closed by server")})
+	}()
+
+	ticker := time.NewTicker(ed.expiryCheckInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return errors.New("stream closed by server")
+			}
+			if ev.err != nil {
+				return ev.err
+			}
+			select {
+			case up <- ev.tgs:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case now := <-ticker.C:
+			if expired := ed.expireStale(now); len(expired) > 0 {
+				select {
+				case up <- expired:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// expiryCheckInterval is how often stream() checks targetTTL/expires_at
+// while the long-lived connection is open. It tracks targetTTL when one is
+// configured (so staleness is noticed promptly) and otherwise falls back to
+// the endpoint's RefreshInterval, the same cadence polling would use.
+func (ed *endpointDiscovery) expiryCheckInterval() time.Duration {
+	if ed.targetTTL > 0 {
+		return ed.targetTTL
+	}
+	if ed.refreshInterval > 0 {
+		return ed.refreshInterval
+	}
+	return time.Minute
+}
+
+// streamDelta is the shape of an incremental stream event: the groups in
+// Added replace or create target groups by source, the sources listed in
+// Removed are deregistered.
+type streamDelta struct {
+	Added   []json.RawMessage `json:"added"`
+	Removed []string          `json:"removed"`
+}
+
+// parseStreamEvent accepts either a full `[]*targetgroup.Group` snapshot or
+// a `{"added":[...],"removed":[...]}` delta and normalizes both into the
+// []*targetgroup.Group shape expected by the refresh channel, honoring each
+// added group's optional "expires_at" the same way a polled response does.
+func (ed *endpointDiscovery) parseStreamEvent(b []byte) ([]*targetgroup.Group, error) {
+	u := ed.url.String()
+
+	trimmed := strings.TrimLeft(string(b), " \t")
+	if strings.HasPrefix(trimmed, "[") {
+		var rawGroups []json.RawMessage
+		if err := json.Unmarshal(b, &rawGroups); err != nil {
+			return nil, err
+		}
+		groups, expiresAt, err := parseRawGroups(rawGroups)
+		if err != nil {
+			return nil, err
+		}
+		return ed.applyExpiry(ed.applyGroups(u, groups), expiresAt), nil
+	}
+
+	var delta streamDelta
+	if err := json.Unmarshal(b, &delta); err != nil {
+		return nil, err
+	}
+
+	added, expiresAt, err := parseRawGroups(delta.Added)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := ed.applyExpiry(ed.applyGroups(u, added), expiresAt)
+	for _, source := range delta.Removed {
+		groups = append(groups, &targetgroup.Group{Source: ed.taggedSource(source)})
+	}
+	return groups, nil
+}
+
+// applyGroups stamps source and meta labels onto freshly parsed groups,
+// tagging the source with this endpoint's index so that add/remove
+// semantics stay correct once results from several endpoints are merged,
+// and merges in any host-local labels configured via LabelsDir.
+func (ed *endpointDiscovery) applyGroups(u string, groups []*targetgroup.Group) []*targetgroup.Group {
+	var dirLabels model.LabelSet
+	if ed.labelsLoader != nil {
+		var err error
+		dirLabels, err = ed.labelsLoader.load()
+		if err != nil {
+			level.Warn(ed.logger).Log("msg", "failed to load labels dir", "err", err)
+		}
+	}
+
+	for i, tg := range groups {
+		if tg == nil {
+			continue
+		}
+		if tg.Source == "" {
+			tg.Source = ed.taggedSource(urlSource(u, i))
+		} else {
+			tg.Source = ed.taggedSource(tg.Source)
+		}
+		if len(tg.Targets) == 0 {
+			tg.Labels = nil
+			tg.Targets = nil
+			delete(ed.lastSeen, tg.Source)
+			delete(ed.expiresAt, tg.Source)
+			continue
+		}
+		if tg.Labels == nil {
+			tg.Labels = model.LabelSet{}
+		}
+		for name, value := range dirLabels {
+			tg.Labels[model.LabelName(ed.labelsDirPrefix)+name] = value
+		}
+		tg.Labels[model.LabelName(ed.labelPrefix)] = model.LabelValue(u)
+
+		if ed.targetTTL > 0 {
+			ed.lastSeen[tg.Source] = time.Now()
+		}
+	}
+	return groups
+}
+
+// markSeen refreshes lastSeen for every already-tracked source in groups
+// without requiring the server to resend them, for the 304 Not Modified
+// case: the server is confirming these sources are still current, just not
+// re-sending their bodies.
+func (ed *endpointDiscovery) markSeen(groups []*targetgroup.Group, now time.Time) {
+	if ed.targetTTL <= 0 {
+		return
+	}
+	for _, tg := range groups {
+		if tg == nil || len(tg.Targets) == 0 {
+			continue
+		}
+		ed.lastSeen[tg.Source] = now
+	}
+}
+
+// applyExpiry records each group's explicit "expires_at" time, if any, so a
+// later expireStale call can deregister it without waiting for the SD
+// server to omit it from a response.
+func (ed *endpointDiscovery) applyExpiry(tgs []*targetgroup.Group, expiresAt []*time.Time) []*targetgroup.Group {
+	for i, tg := range tgs {
+		if tg == nil || i >= len(expiresAt) || expiresAt[i] == nil {
+			continue
+		}
+		ed.expiresAt[tg.Source] = *expiresAt[i]
+	}
+	return tgs
+}
+
+// expireStale returns deregistration groups (empty target groups) for every
+// source that has exceeded targetTTL since it was last seen, or whose
+// explicit "expires_at" has passed, independent of whether the current
+// refresh attempt succeeded.
+func (ed *endpointDiscovery) expireStale(now time.Time) []*targetgroup.Group {
+	var expired []*targetgroup.Group
+
+	if ed.targetTTL > 0 {
+		for source, seen := range ed.lastSeen {
+			if now.Sub(seen) < ed.targetTTL {
+				continue
+			}
+			expired = append(expired, &targetgroup.Group{Source: source})
+			delete(ed.lastSeen, source)
+			delete(ed.expiresAt, source)
+		}
+	}
+
+	for source, exp := range ed.expiresAt {
+		if now.Before(exp) {
+			continue
+		}
+		expired = append(expired, &targetgroup.Group{Source: source})
+		delete(ed.lastSeen, source)
+		delete(ed.expiresAt, source)
+	}
+
+	return expired
+}
+
+// taggedSource prefixes a target group source with this endpoint's index,
+// so that two endpoints returning the same source string don't collide
+// once Discovery merges their streams.
+func (ed *endpointDiscovery) taggedSource(source string) string {
+	return fmt.Sprintf("%d:%s", ed.index, source)
+}
+
+func urlSource(u string, i int) string {
+	return fmt.Sprintf("%s:%d", u, i)
+}
+
+func (ed *endpointDiscovery) refresh(ctx context.Context) ([]*targetgroup.Group, error) {
+	tgs, err := ed.doRefresh(ctx)
+
+	// Compute expiry after doRefresh, not before: a successful doRefresh
+	// (or a 304) has already refreshed lastSeen for every source it
+	// confirmed via applyGroups/markSeen, so a source reconfirmed this
+	// very tick is never simultaneously reported fresh in tgs and stale
+	// in expired.
+	expired := ed.expireStale(time.Now())
+
+	if err != nil {
+		if ed.cacheFile != "" && ed.lastGood != nil && ed.consecutiveFailures < maxCacheFailures {
+			ed.consecutiveFailures++
+			level.Warn(ed.logger).Log("msg", "http_sd refresh failed, falling back to cache file", "file", ed.cacheFile, "err", err)
+			return append(ed.lastGood, expired...), nil
+		}
+		if len(expired) > 0 {
+			return expired, nil
+		}
+		return nil, err
+	}
+
+	ed.consecutiveFailures = 0
+	if tgs != nil {
+		// A source that the previous successful response carried and this
+		// one omits is sent as an empty group, which deregisters it.
+		current := make(map[string]bool, len(tgs))
+		for _, tg := range tgs {
+			current[tg.Source] = true
+		}
+		for _, old := range ed.lastGood {
+			if old != nil && len(old.Targets) > 0 && !current[old.Source] {
+				tgs = append(tgs, &targetgroup.Group{Source: old.Source})
+			}
+		}
+		ed.lastGood = tgs
+		if ed.cacheFile != "" {
+			if err := writeCacheFile(ed.cacheFile, ed.etag, tgs); err != nil {
+				level.Warn(ed.logger).Log("msg", "failed to write http_sd cache file", "file", ed.cacheFile, "err", err)
+			}
+		}
+	}
+
+	return append(tgs, expired...), nil
 }
 
-func (d *Discovery) refresh(ctx context.Context) ([]*targetgroup.Group, error) {
-	u := d.url.String()
+func (ed *endpointDiscovery) doRefresh(ctx context.Context) ([]*targetgroup.Group, error) {
+	u := ed.url.String()
 
 	req := &http.Request{
 		Method:     http.MethodGet,
-		URL:        d.url,
+		URL:        ed.url,
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 		Header:     make(http.Header),
-		Host:       d.url.Host,
+		Host:       ed.url.Host,
 	}
 
 	req = req.WithContext(ctx)
 
-	if d.etag != "" {
-		req.Header.Set("If-None-Match", d.etag)
+	if ed.etag != "" {
+		req.Header.Set("If-None-Match", ed.etag)
 	}
 
-	resp, err := d.client.Do(req)
+	resp, err := ed.client.Do(req)
 	if err != nil {
 		return nil, errors.Wrapf(err, "http_sd: failed to get url %s", u)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusNotModified {
+		// The server is actively confirming these sources are still
+		// current, just without resending them; count that as a sighting
+		// so target_ttl doesn't expire a target the server keeps 304-ing.
+		ed.markSeen(ed.lastGood, time.Now())
 		return nil, nil
 	}
 
@@ -143,25 +704,107 @@ func (d *Discovery) refresh(ctx context.Context) ([]*targetgroup.Group, error) {
 		return nil, errors.Wrapf(err, "http_sd: failed to read body from url %s", u)
 	}
 
-	var tg targetgroup.Group
-
-	if err := json.Unmarshal(body, &tg); err != nil {
+	tgs, warnings, expiresAt, err := parseResponse(body)
+	if err != nil {
 		return nil, errors.Wrapf(err, "http_sd: failed to parse body from url %s", u)
 	}
 
-	tg.Source = u
+	for _, w := range warnings {
+		level.Warn(ed.logger).Log("msg", "http_sd endpoint returned a warning", "url", u, "warning", w)
+	}
+
+	ed.mtx.Lock()
+	ed.lastWarnings = warnings
+	ed.mtx.Unlock()
+
+	ed.etag = resp.Header.Get("ETag")
+
+	tgs = ed.applyGroups(u, tgs)
+	return ed.applyExpiry(tgs, expiresAt), nil
+}
+
+// envelope is the Prometheus API client style response wrapper: a bare
+// array of target groups is still accepted for backwards compatibility.
+type envelope struct {
+	Status   string            `json:"status"`
+	Data     []json.RawMessage `json:"data"`
+	Warnings []string          `json:"warnings"`
+}
 
-	if len(tg.Targets) == 0 {
-		tg.Labels = nil
-		tg.Targets = nil
-		return []*targetgroup.Group{&tg}, nil
+// groupExpiry captures the optional "expires_at" field an SD server may set
+// on a target group to mark it for deregistration without another poll
+// cycle, alongside whatever fields targetgroup.Group itself understands.
+type groupExpiry struct {
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// parseResponse accepts either a bare `[]*targetgroup.Group` array or an
+// `{"status":"success","data":[...],"warnings":[...]}` envelope and returns
+// the target groups, any non-fatal warnings, and each group's optional
+// explicit expiry time (nil if not set).
+func parseResponse(body []byte) ([]*targetgroup.Group, []string, []*time.Time, error) {
+	trimmed := strings.TrimLeft(string(body), " \t\r\n")
+
+	var rawGroups []json.RawMessage
+	var warnings []string
+	if strings.HasPrefix(trimmed, "[") {
+		if err := json.Unmarshal(body, &rawGroups); err != nil {
+			return nil, nil, nil, err
+		}
+	} else {
+		// Only treat the body as an envelope if it actually carries a
+		// top-level "data" array; otherwise it's neither a valid bare
+		// array nor a valid envelope.
+		var probe map[string]json.RawMessage
+		if err := json.Unmarshal(body, &probe); err != nil {
+			return nil, nil, nil, err
+		}
+		if _, ok := probe["data"]; !ok {
+			return nil, nil, nil, errors.Errorf("cannot unmarshal object into Go value of type []*targetgroup.Group")
+		}
+
+		var env envelope
+		if err := json.Unmarshal(body, &env); err != nil {
+			return nil, nil, nil, err
+		}
+		rawGroups = env.Data
+		warnings = env.Warnings
+	}
+
+	tgs, expiresAt, err := parseRawGroups(rawGroups)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
-	if tg.Labels == nil {
-		tg.Labels = model.LabelSet{}
+	return tgs, warnings, expiresAt, nil
+}
+
+// parseRawGroups unmarshals each raw JSON group into a targetgroup.Group,
+// along with its optional "expires_at" field, which targetgroup.Group
+// itself doesn't understand.
+func parseRawGroups(rawGroups []json.RawMessage) ([]*targetgroup.Group, []*time.Time, error) {
+	tgs := make([]*targetgroup.Group, len(rawGroups))
+	expiresAt := make([]*time.Time, len(rawGroups))
+	for i, raw := range rawGroups {
+		var tg targetgroup.Group
+		if err := json.Unmarshal(raw, &tg); err != nil {
+			return nil, nil, err
+		}
+		tgs[i] = &tg
+
+		var exp groupExpiry
+		if err := json.Unmarshal(raw, &exp); err == nil {
+			expiresAt[i] = exp.ExpiresAt
+		}
 	}
 
-	tg.Labels[httpSourceLabel] = model.LabelValue(u)
+	return tgs, expiresAt, nil
+}
 
-	return []*targetgroup.Group{&tg}, nil
+// LastWarnings returns the non-fatal warnings reported by this endpoint on
+// its most recent successful refresh.
+func (ed *endpointDiscovery) LastWarnings() []string {
+	ed.mtx.Lock()
+	defer ed.mtx.Unlock()
+	return ed.lastWarnings
 }
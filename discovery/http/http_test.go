@@ -20,10 +20,14 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+
 	"github.com/prometheus/prometheus/discovery/targetgroup"
 	"github.com/prometheus/prometheus/util/testutil"
 )
@@ -191,11 +195,12 @@ func TestHTTP(t *testing.T) {
 
 			sd, err := NewDiscovery(&conf, nil)
 			testutil.Ok(t, err)
+			testutil.Equals(t, 1, len(sd.subs))
 
 			for i, body := range tc.bodies {
 				handler.body = body
 
-				tgs, err := sd.refresh(context.Background())
+				tgs, err := sd.subs[0].refresh(context.Background())
 
 				if tc.expectedError != "" {
 					testutil.NotOk(t, err)
@@ -224,7 +229,7 @@ func TestHTTP(t *testing.T) {
 
 func fillInTargetGroups(u string, tgs []*targetgroup.Group) {
 	for i, tg := range tgs {
-		tg.Source = fmt.Sprintf("%s:%d", u, i)
+		tg.Source = fmt.Sprintf("0:%s:%d", u, i)
 
 		if len(tg.Targets) == 0 {
 			continue
@@ -236,6 +241,396 @@ func fillInTargetGroups(u string, tgs []*targetgroup.Group) {
 	}
 }
 
+func TestSDConfigUnmarshalModeDefaultsToPoll(t *testing.T) {
+	var conf SDConfig
+	err := yaml.Unmarshal([]byte(`url: http://example.com/sd`), &conf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, ModePoll, conf.Mode)
+}
+
+func TestSDConfigUnmarshalRejectsUnknownMode(t *testing.T) {
+	var conf SDConfig
+	err := yaml.Unmarshal([]byte(`
+url: http://example.com/sd
+mode: bogus
+`), &conf)
+	testutil.NotOk(t, err)
+}
+
+func TestSDConfigUnmarshalFoldsLegacyURLIntoURLs(t *testing.T) {
+	var conf SDConfig
+	err := yaml.Unmarshal([]byte(`
+url: http://example.com/sd
+refresh_interval: 1m
+`), &conf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(conf.URLs))
+	testutil.Equals(t, "http://example.com/sd", conf.URLs[0].URL.String())
+	testutil.Equals(t, model.Duration(time.Minute), conf.URLs[0].RefreshInterval)
+}
+
+func TestSDConfigUnmarshalRejectsURLAndURLs(t *testing.T) {
+	var conf SDConfig
+	err := yaml.Unmarshal([]byte(`
+url: http://example.com/sd
+urls:
+  - url: http://example.com/other
+`), &conf)
+	testutil.NotOk(t, err)
+}
+
+func TestSDConfigUnmarshalMultipleURLs(t *testing.T) {
+	var conf SDConfig
+	err := yaml.Unmarshal([]byte(`
+urls:
+  - url: http://a.example.com/sd
+    label_prefix: __meta_http_a_
+  - url: http://b.example.com/sd
+    refresh_interval: 10s
+`), &conf)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(conf.URLs))
+	testutil.Equals(t, "__meta_http_a_", conf.URLs[0].LabelPrefix)
+	testutil.Equals(t, model.Duration(10*time.Second), conf.URLs[1].RefreshInterval)
+
+	sd, err := NewDiscovery(&conf, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(sd.subs))
+	testutil.Equals(t, 0, sd.subs[0].index)
+	testutil.Equals(t, 1, sd.subs[1].index)
+}
+
+func TestParseStreamEventSnapshot(t *testing.T) {
+	u, err := url.Parse("http://example.com/sd")
+	testutil.Ok(t, err)
+	ed := &endpointDiscovery{url: u, labelPrefix: string(httpSourceLabel)}
+
+	tgs, err := ed.parseStreamEvent([]byte(`[ {"targets": [ "somehost:8080" ]} ]`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, ed.taggedSource(urlSource(u.String(), 0)), tgs[0].Source)
+}
+
+func TestParseStreamEventDelta(t *testing.T) {
+	u, err := url.Parse("http://example.com/sd")
+	testutil.Ok(t, err)
+	ed := &endpointDiscovery{url: u, labelPrefix: string(httpSourceLabel)}
+
+	tgs, err := ed.parseStreamEvent([]byte(`{"added": [ {"targets": [ "somehost:8080" ]} ], "removed": ["old-source"]}`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Equals(t, ed.taggedSource("old-source"), tgs[1].Source)
+}
+
+func TestParseResponseRejectsObjectWithoutData(t *testing.T) {
+	_, _, _, err := parseResponse([]byte(`{}`))
+	testutil.NotOk(t, err)
+	if !strings.Contains(err.Error(), "cannot unmarshal object into Go value") {
+		t.Fatal("error did not contain expected text")
+	}
+}
+
+func TestParseResponseExtractsExpiresAt(t *testing.T) {
+	tgs, _, expiresAt, err := parseResponse([]byte(`[
+		{"targets": [ "somehost:8080" ], "expires_at": "2020-01-01T00:00:00Z"},
+		{"targets": [ "anotherhost:9090" ]}
+	]`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 2, len(tgs))
+	testutil.Assert(t, expiresAt[0] != nil, "expected expires_at to be parsed")
+	testutil.Equals(t, true, expiresAt[1] == nil)
+}
+
+func TestEndpointDiscoveryExpireStaleByTTL(t *testing.T) {
+	ed := &endpointDiscovery{
+		targetTTL: time.Minute,
+		lastSeen:  map[string]time.Time{"stale": time.Now().Add(-2 * time.Minute), "fresh": time.Now()},
+		expiresAt: map[string]time.Time{},
+	}
+
+	expired := ed.expireStale(time.Now())
+	testutil.Equals(t, 1, len(expired))
+	testutil.Equals(t, "stale", expired[0].Source)
+	testutil.Equals(t, 0, len(expired[0].Targets))
+}
+
+func TestEndpointDiscoveryExpireStaleByExplicitExpiry(t *testing.T) {
+	ed := &endpointDiscovery{
+		lastSeen:  map[string]time.Time{},
+		expiresAt: map[string]time.Time{"expiring": time.Now().Add(-time.Second)},
+	}
+
+	expired := ed.expireStale(time.Now())
+	testutil.Equals(t, 1, len(expired))
+	testutil.Equals(t, "expiring", expired[0].Source)
+}
+
+func TestEndpointDiscoveryRunStreamsUpdates(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`[ {"targets": [ "somehost:8080" ]} ]` + "\n"))
+		flusher.Flush()
+		// Keep the connection open; the test only needs the one event.
+		<-r.Context().Done()
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	testutil.Ok(t, err)
+
+	conf := SDConfig{
+		URL:             config.URL{URL: u},
+		Mode:            ModeStream,
+		RefreshInterval: model.Duration(time.Minute),
+	}
+
+	sd, err := NewDiscovery(&conf, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(sd.subs))
+
+	up := make(chan []*targetgroup.Group)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sd.subs[0].Run(ctx, up)
+
+	select {
+	case tgs := <-up:
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, []model.LabelSet{{model.AddressLabel: "somehost:8080"}}, tgs[0].Targets)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for a streamed update")
+	}
+}
+
+func TestEndpointDiscoveryRunFallsBackToPollOnStreamError(t *testing.T) {
+	var streamAttempts, pollAttempts int32
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.Header.Get("Accept"), "event-stream") {
+			atomic.AddInt32(&streamAttempts, 1)
+			// A broken stream endpoint: refuse the request outright so
+			// stream() fails immediately and Run falls back to polling.
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		atomic.AddInt32(&pollAttempts, 1)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(`[ {"targets": [ "somehost:8080" ]} ]`))
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	testutil.Ok(t, err)
+
+	conf := SDConfig{
+		URL:             config.URL{URL: u},
+		Mode:            ModeStream,
+		RefreshInterval: model.Duration(10 * time.Millisecond),
+	}
+
+	sd, err := NewDiscovery(&conf, nil)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(sd.subs))
+
+	up := make(chan []*targetgroup.Group)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go sd.subs[0].Run(ctx, up)
+
+	select {
+	case tgs := <-up:
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, []model.LabelSet{{model.AddressLabel: "somehost:8080"}}, tgs[0].Targets)
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for poll fallback to deliver targets")
+	}
+
+	testutil.Assert(t, atomic.LoadInt32(&streamAttempts) >= 1, "expected at least one stream attempt")
+	testutil.Assert(t, atomic.LoadInt32(&pollAttempts) >= 1, "expected Run to fall back to polling after the stream failed")
+}
+
+func TestEndpointDiscoveryStreamExpiresStaleTargetsWithoutPolling(t *testing.T) {
+	body := `[ {"targets": [ "somehost:8080" ]} ]` + "\n"
+	blocked := make(chan struct{})
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
+		flusher.Flush()
+		// Keep the connection open so the only way expiry can be
+		// noticed is the ticker inside stream(), not a poll tick.
+		<-blocked
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+	defer close(blocked)
+
+	u, err := url.Parse(s.URL)
+	testutil.Ok(t, err)
+
+	rt, err := config.NewRoundTripperFromConfig(config.HTTPClientConfig{}, "http_sd", false)
+	testutil.Ok(t, err)
+
+	ed := &endpointDiscovery{
+		index:       0,
+		labelPrefix: string(httpSourceLabel),
+		url:         u,
+		client:      &http.Client{Transport: rt},
+		mode:        ModeStream,
+		targetTTL:   50 * time.Millisecond,
+		lastSeen:    map[string]time.Time{},
+		expiresAt:   map[string]time.Time{},
+		logger:      nil,
+	}
+
+	up := make(chan []*targetgroup.Group)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go ed.stream(ctx, up)
+
+	select {
+	case tgs := <-up:
+		testutil.Equals(t, 1, len(tgs))
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for initial stream snapshot")
+	}
+
+	select {
+	case tgs := <-up:
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, 0, len(tgs[0].Targets))
+	case <-ctx.Done():
+		t.Fatal("timed out waiting for stream to expire the stale target without a poll tick")
+	}
+}
+
+func TestEndpointDiscoveryRefreshDoesNotFlapAReappearingSource(t *testing.T) {
+	body := `[ {"targets": [ "somehost:8080" ]} ]`
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	testutil.Ok(t, err)
+
+	rt, err := config.NewRoundTripperFromConfig(config.HTTPClientConfig{}, "http_sd", false)
+	testutil.Ok(t, err)
+
+	// target_ttl below the 15ms gap between refreshes: the previous sighting
+	// has always lapsed by the next refresh, so only reconfirming the source
+	// before expiry is computed keeps it from being reported stale.
+	ed := &endpointDiscovery{
+		index:       0,
+		labelPrefix: string(httpSourceLabel),
+		url:         u,
+		client:      &http.Client{Transport: rt},
+		mode:        ModePoll,
+		targetTTL:   10 * time.Millisecond,
+		lastSeen:    map[string]time.Time{},
+		expiresAt:   map[string]time.Time{},
+		logger:      nil,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 5; i++ {
+		tgs, err := ed.refresh(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 1, len(tgs))
+		testutil.Equals(t, 1, len(tgs[0].Targets))
+		time.Sleep(15 * time.Millisecond)
+	}
+}
+
+func TestEndpointDiscoveryRefreshKeepsTargetAliveAcrossNotModified(t *testing.T) {
+	const etag = `"v1"`
+	body := `[ {"targets": [ "somehost:8080" ]} ]`
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(body))
+	})
+
+	s := httptest.NewServer(handler)
+	defer s.Close()
+
+	u, err := url.Parse(s.URL)
+	testutil.Ok(t, err)
+
+	rt, err := config.NewRoundTripperFromConfig(config.HTTPClientConfig{}, "http_sd", false)
+	testutil.Ok(t, err)
+
+	ed := &endpointDiscovery{
+		index:       0,
+		labelPrefix: string(httpSourceLabel),
+		url:         u,
+		client:      &http.Client{Transport: rt},
+		mode:        ModePoll,
+		targetTTL:   20 * time.Millisecond,
+		lastSeen:    map[string]time.Time{},
+		expiresAt:   map[string]time.Time{},
+		logger:      nil,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// First refresh gets the full body and records the source.
+	tgs, err := ed.refresh(ctx)
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+
+	// Every refresh after this one is answered with 304 Not Modified. If
+	// that isn't treated as a sighting, the source expires once targetTTL
+	// elapses even though the server keeps confirming it's still current.
+	for i := 0; i < 5; i++ {
+		time.Sleep(10 * time.Millisecond)
+		tgs, err := ed.refresh(ctx)
+		testutil.Ok(t, err)
+		testutil.Equals(t, 0, len(tgs))
+	}
+}
+
+func TestParseResponseBareArray(t *testing.T) {
+	tgs, warnings, _, err := parseResponse([]byte(`[ {"targets": [ "somehost:8080" ]} ]`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, 0, len(warnings))
+}
+
+func TestParseResponseEnvelopeWithWarnings(t *testing.T) {
+	tgs, warnings, _, err := parseResponse([]byte(`{
+		"status": "success",
+		"data": [ {"targets": [ "somehost:8080" ]} ],
+		"warnings": [ "backend xyz unreachable" ]
+	}`))
+	testutil.Ok(t, err)
+	testutil.Equals(t, 1, len(tgs))
+	testutil.Equals(t, []string{"backend xyz unreachable"}, warnings)
+}
+
 type testHandler struct {
 	statusCode int
 	body       string
@@ -0,0 +1,108 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/common/model"
+)
+
+// defaultLabelsDirPrefix is prepended to every label name read from
+// SDConfig.LabelsDir unless the user configures their own.
+const defaultLabelsDirPrefix = model.MetaLabelPrefix + "labeldir_"
+
+// labelsDirLoader reads one label per file from a directory and caches the
+// result until one of the files changes, so hot-path refreshes don't re-read
+// file contents on every call. Per-file mtimes are tracked rather than the
+// directory's own mtime, since editing a file in place (the ordinary way to
+// update one label) changes only that file's mtime, not its parent's.
+type labelsDirLoader struct {
+	dir    string
+	logger log.Logger
+
+	mtx        sync.Mutex
+	fileMtimes map[string]int64
+	labels     model.LabelSet
+}
+
+func newLabelsDirLoader(dir string, logger log.Logger) *labelsDirLoader {
+	return &labelsDirLoader{
+		dir:    dir,
+		logger: logger,
+	}
+}
+
+// load returns the label set read from the directory, re-reading file
+// contents only if a file was added, removed, or its mtime has changed
+// since the previous call.
+func (l *labelsDirLoader) load() (model.LabelSet, error) {
+	entries, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	mtimes := make(map[string]int64, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		mtimes[entry.Name()] = entry.ModTime().UnixNano()
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if l.labels != nil && mtimesEqual(l.fileMtimes, mtimes) {
+		return l.labels, nil
+	}
+
+	labels := model.LabelSet{}
+	for fileName := range mtimes {
+		name := model.LabelName(fileName)
+		if !name.IsValid() {
+			level.Warn(l.logger).Log("msg", "skipping invalid label file name in labels dir", "file", fileName)
+			continue
+		}
+
+		content, err := ioutil.ReadFile(filepath.Join(l.dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		labels[name] = model.LabelValue(strings.TrimSpace(string(content)))
+	}
+
+	l.fileMtimes = mtimes
+	l.labels = labels
+
+	return labels, nil
+}
+
+func mtimesEqual(a, b map[string]int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, mtime := range a {
+		if b[name] != mtime {
+			return false
+		}
+	}
+	return true
+}
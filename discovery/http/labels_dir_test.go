@@ -0,0 +1,86 @@
+// Copyright 2020 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package http
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/util/testutil"
+)
+
+func TestLabelsDirLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels_dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "rack"), []byte("rack-42\n"), 0644))
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("prod"), 0644))
+
+	l := newLabelsDirLoader(dir, nil)
+	labels, err := l.load()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelSet{
+		"rack": "rack-42",
+		"env":  "prod",
+	}, labels)
+}
+
+func TestLabelsDirLoaderReturnsCachedMapWhenUnmodified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels_dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	testutil.Ok(t, ioutil.WriteFile(filepath.Join(dir, "env"), []byte("prod"), 0644))
+
+	l := newLabelsDirLoader(dir, nil)
+	first, err := l.load()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("prod"), first["env"])
+
+	// While no file changes, load hands back the cached map itself, so a
+	// mutation of the first result is visible in the second.
+	first["env"] = "mutated"
+	second, err := l.load()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("mutated"), second["env"])
+}
+
+func TestLabelsDirLoaderPicksUpEditedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "labels_dir")
+	testutil.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rack")
+	testutil.Ok(t, ioutil.WriteFile(path, []byte("rack-1"), 0644))
+
+	l := newLabelsDirLoader(dir, nil)
+	first, err := l.load()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("rack-1"), first["rack"])
+
+	// Editing a file in place, the ordinary way to update one label,
+	// does not change the parent directory's own mtime.
+	testutil.Ok(t, ioutil.WriteFile(path, []byte("rack-2"), 0644))
+	future := time.Now().Add(time.Hour)
+	testutil.Ok(t, os.Chtimes(path, future, future))
+
+	second, err := l.load()
+	testutil.Ok(t, err)
+	testutil.Equals(t, model.LabelValue("rack-2"), second["rack"])
+}